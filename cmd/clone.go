@@ -34,23 +34,49 @@ The data flow (sourcecode flow) is similar to this diagram.
 package cmd
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	exec "os/exec"
+	"strconv"
+	"strings"
 
+	"github.com/bitswan-space/bitswan-gitops/internal/diskspace"
+	"github.com/bitswan-space/bitswan-gitops/internal/docker"
 	"github.com/bitswan-space/bitswan-gitops/internal/dockercompose"
 	"github.com/bitswan-space/bitswan-gitops/internal/dockerhub"
-	"github.com/dchest/uniuri"
 	cp "github.com/otiai10/copy"
 	"github.com/spf13/cobra"
 )
 
 type cloneOptions struct {
-	creDir string
+	creDir        string
+	minDisk       int
+	labels        map[string]string
+	gitDepth      int
+	branch        string
+	pinDigest     bool
+	forceRecreate bool
+	bindAddress   string
+	force         bool
+	tagStrategy   string
+	registry      string
+	refresh       bool
+	// random is the source for generated secrets, tests may swap it for a deterministic one
+	random io.Reader
 }
 
 func defaultCloneOptions() *cloneOptions {
-	return &cloneOptions{}
+	return &cloneOptions{
+		minDisk:     2,
+		bindAddress: "127.0.0.1",
+		tagStrategy: string(dockerhub.TagStrategyDate),
+		random:      rand.Reader,
+	}
 }
 
 func newCloneCmd() *cobra.Command {
@@ -59,22 +85,77 @@ func newCloneCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "clone [flags] <repo> <dest>",
 		Short: "Clone an existing bitswan-gitops repository and deploy the pipelines in it",
-		Args:  cobra.RangeArgs(1, 2),
-		RunE:  o.run,
+		Long: `Clone an existing bitswan-gitops repository and deploy the pipelines in it.
+
+With --registry the gitops image is taken from a private registry instead of
+DockerHub. A path in the registry URL names the repository to use, such as
+https://harbor.example.com/myproject/pipeline-runtime-environment. Set $BITSWAN_REGISTRY_USERNAME and $BITSWAN_REGISTRY_PASSWORD to log
+in to it, for example with a Harbor robot account, or $BITSWAN_REGISTRY_TOKEN
+to send a bearer token as is.`,
+		Args: invalidArgs(cobra.RangeArgs(1, 2)),
+		RunE: o.run,
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			// The repo is a URL, only the destination is a local directory
+			if len(args) == 1 {
+				return nil, cobra.ShellCompDirectiveFilterDirs
+			}
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
 	}
 
 	cmd.Flags().StringVar(&o.creDir, "cre-dir", "", "The directory where this cre's pipelines are found")
+	cmd.Flags().StringToStringVar(&o.labels, "label", nil, "Label to set on the created containers, as key=value (can be repeated)")
+	cmd.Flags().StringVar(&o.branch, "branch", "", "Branch or tag of the repo to clone instead of its default branch")
+	cmd.Flags().IntVar(&o.gitDepth, "git-depth", 0, "Create a shallow clone with history truncated to this many commits (0 clones the full history)")
+	cmd.Flags().BoolVar(&o.pinDigest, "pin-digest", false, "Pin the gitops image by digest in docker-compose.yml instead of by tag only")
+	cmd.Flags().BoolVar(&o.forceRecreate, "force-recreate", false, "Recreate the containers even if their configuration and image haven't changed")
+	cmd.Flags().StringVar(&o.bindAddress, "bind-address", o.bindAddress, "Host address that published ports (the no-cloud mosquitto broker) listen on, use 0.0.0.0 for all interfaces")
+	cmd.Flags().BoolVar(&o.force, "force", false, "Deploy even if a compose project with the same name already has containers")
+	cmd.Flags().StringVar(&o.tagStrategy, "tag-strategy", o.tagStrategy, "How to pick the latest gitops image tag: date (YYYY-N-git-SHA tags) or semver")
+	cmd.RegisterFlagCompletionFunc("tag-strategy", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{string(dockerhub.TagStrategyDate), string(dockerhub.TagStrategySemver)}, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.Flags().StringVar(&o.registry, "registry", "", "Registry API URL to take the gitops image from instead of DockerHub (default $BITSWAN_REGISTRY_API)")
+	cmd.Flags().BoolVar(&o.refresh, "refresh", false, "Look up the latest gitops image version even if a cached result is still fresh")
+	cmd.Flags().IntVar(&o.minDisk, "min-disk", o.minDisk, "Minimum free space in GiB required in the docker data root (0 disables the check)")
 
 	return cmd
 }
 
-func (o *cloneOptions) run(cmd *cobra.Command, args []string) error {
+func (o *cloneOptions) run(cmd *cobra.Command, args []string) (err error) {
+	if o.gitDepth < 0 {
+		return newCLIError(errorCodeInvalidArgument, "",
+			fmt.Errorf("--git-depth must not be negative: %d", o.gitDepth))
+	}
+	tagStrategy, err := dockerhub.ParseTagStrategy(o.tagStrategy)
+	if err != nil {
+		return newCLIError(errorCodeInvalidArgument, "", err)
+	}
+	image, err := dockerhub.ImageRepository(o.registry)
+	if err != nil {
+		return newCLIError(errorCodeInvalidArgument, "", err)
+	}
+	if net.ParseIP(o.bindAddress) == nil {
+		return newCLIError(errorCodeInvalidArgument, "",
+			fmt.Errorf("--bind-address is not a valid IP address: %q", o.bindAddress))
+	}
+
+	log := newLogger(cmd)
+
+	// Check for everything we shell out to before touching anything
+	if missing := missingTools("git", "docker", "docker-compose"); len(missing) > 0 {
+		return newCLIError(errorCodeMissingTools, "install them and make sure they are on your PATH",
+			fmt.Errorf("required tools not found: %s", strings.Join(missing, ", ")))
+	}
+
 	// Promp the user to either enter their bitswan.space gitops key or to enter "no-cloud" for standalone mode
 	bitswanSpaceKey := ""
 	for len(bitswanSpaceKey) < 32 {
-		fmt.Println("Enter your cloud account gitops key or enter 'no-cloud' for standalone mode")
-		fmt.Print("Enter cloud key [key/no-cloud/q]: ")
-		fmt.Scanln(&bitswanSpaceKey)
+		fmt.Fprintln(cmd.OutOrStdout(), "Enter your cloud account gitops key or enter 'no-cloud' for standalone mode")
+		fmt.Fprint(cmd.OutOrStdout(), "Enter cloud key [key/no-cloud/q]: ")
+		if _, err := fmt.Fscanln(cmd.InOrStdin(), &bitswanSpaceKey); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return newCLIError(errorCodeInvalidArgument, "", errors.New("no cloud key entered"))
+		}
 		if bitswanSpaceKey == "no-cloud" {
 			bitswanSpaceKey = ""
 			break
@@ -85,41 +166,92 @@ func (o *cloneOptions) run(cmd *cobra.Command, args []string) error {
 	}
 	noCloud := bitswanSpaceKey == ""
 
-
 	repoUrl := args[0]
 	// create the destination directory from args[1]
 	dest := "bitswan-gitops"
 	if len(args) == 2 {
 		dest = args[1]
 	}
+	dest, err = expandPath(dest)
+	if err != nil {
+		return newCLIError(errorCodeInvalidArgument, "", err)
+	}
+	// The compose project name comes from the destination's directory name, so an unrelated deployment could share it
+	projectName := dockercompose.ProjectName(dest)
+	if projectName == "" {
+		return newCLIError(errorCodeInvalidArgument, "use a destination whose name contains lowercase letters, digits, _ or -",
+			fmt.Errorf("cannot derive a compose project name from destination %s", dest))
+	}
 	// If the dest directory already exists, complain and exit
 	if _, err := os.Stat(dest); !os.IsNotExist(err) {
-		return fmt.Errorf("destination directory already exists: %s", dest)
+		return newCLIError(errorCodeDestinationExists, "choose another destination or remove the existing directory",
+			fmt.Errorf("destination directory already exists: %s", dest))
+	}
+	// Make sure docker is up and the images will fit before we create anything
+	if err := docker.CheckDaemon(); err != nil {
+		return newCLIError(errorCodeDockerUnreachable, "start Docker and make sure your user can access it", err)
+	}
+	if o.minDisk > 0 {
+		rootDir, err := docker.RootDir()
+		if err != nil {
+			return newCLIError(errorCodeDockerUnreachable, "", err)
+		}
+		if err := diskspace.Check(rootDir, o.minDisk, log.ErrWriter()); err != nil {
+			return newCLIError(errorCodeInsufficientDisk, "free up space in the docker data root or lower --min-disk", err)
+		}
 	}
-	os.Mkdir(dest, 0755)
+	containers, err := docker.ProjectContainers(projectName)
+	if err != nil {
+		return newCLIError(errorCodeDockerUnreachable, "", err)
+	}
+	if len(containers) > 0 && !o.force {
+		return newCLIError(errorCodeProjectExists, "choose a destination with a different directory name or pass --force to deploy into the existing project",
+			fmt.Errorf("compose project %s already has containers: %s", projectName, strings.Join(containers, ", ")))
+	}
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return fmt.Errorf("error creating destination directory: %w", err)
+	}
+	// Don't leave a half set up deployment behind if anything below fails. Once docker-compose has
+	// been launched it may have created containers, and the files in dest are needed to take them down.
+	launched := false
+	defer func() {
+		if err != nil && !launched {
+			os.RemoveAll(dest)
+		}
+	}()
 	// Build path of prod subdir
 	prod := dest + "/prod"
 	// clone into the prod subdir of the dest directory
-	com := exec.Command("git", "clone", repoUrl, prod)
-	com.Stdout = os.Stdout
-	com.Stderr = os.Stderr
+	gitArgs := o.gitCloneArgs(repoUrl, prod, log.Quiet(), isTerminal(cmd.ErrOrStderr()))
+	log.Command("git", gitArgs...)
+	com := exec.Command("git", gitArgs...)
+	// Also keep the end of git's stderr, a failed clone must say why when it wasn't streamed to the user
+	gitStderr := newTailBuffer(commandOutputTail)
+	com.Stdout = log.Writer()
+	com.Stderr = io.MultiWriter(log.ErrWriter(), gitStderr)
 	// Execute the command
 	if err := com.Run(); err != nil {
-		return fmt.Errorf("error cloning repo: %w", err)
+		err = fmt.Errorf("error cloning repo: %w", err)
+		if !log.StreamsErrors() {
+			err = fmt.Errorf("%w\n%s", err, gitStderr)
+		}
+		return newCLIError(errorCodeCloneFailed, "check the repository URL, --branch and your git credentials", err)
 	}
 
 	// copy the prod directory to dev
 	dev := dest + "/dev"
 	// copy the prod directory to dev
-	err := cp.Copy(prod, dev)
+	err = cp.Copy(prod, dev)
 	if err != nil {
 		return fmt.Errorf("error copying prod to dev: %w", err)
 	}
 
 	// Set up the gitops env file
 	// Generate a secret key for the webhook
-	key := uniuri.NewLen(64)
-	key = "bs-secrete-webhook-key-" + key
+	key, err := newWebhookSecret(o.random)
+	if err != nil {
+		return fmt.Errorf("error generating webhook secret: %w", err)
+	}
 
 	// Start by creating dict of env vars
 	env := map[string]string{
@@ -141,30 +273,123 @@ func (o *cloneOptions) run(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create docker-compose.yml
-	latestVersion, err := dockerhub.GetLatestBitswanGitopsVersion()
+	latestVersion, digest, err := dockerhub.GetLatestBitswanGitopsImage(dockerhub.LookupOptions{
+		Registry:      o.registry,
+		Strategy:      tagStrategy,
+		Refresh:       o.refresh,
+		RequireDigest: o.pinDigest,
+		Warnings:      log.ErrWriter(),
+	})
 	if err != nil {
-		return fmt.Errorf("error getting latest bitswan-gitops version: %w", err)
+		return newCLIError(errorCodeImageLookupFailed, "check that the image registry is reachable",
+			fmt.Errorf("error getting latest bitswan-gitops version: %w", err))
 	}
-	dockercompose.CreateDockerComposeFile(
-		dest,
-		latestVersion,
-		o.creDir,
-		noCloud,
-	)
-
-	// set the cwd to the dest directory and launch docker-compose
-	err = os.Chdir(dest)
+	if o.pinDigest {
+		if digest == "" {
+			return newCLIError(errorCodeImageLookupFailed, "retry without --pin-digest",
+				fmt.Errorf("no digest found for bitswan-gitops version %s", latestVersion))
+		}
+		latestVersion += "@" + digest
+		log.Infof("Pinning bitswan-gitops image to %s:%s", image, latestVersion)
+	}
+	composeOpts := dockercompose.ComposeOptions{
+		Dest:        dest,
+		Image:       image,
+		Version:     latestVersion,
+		CreDir:      o.creDir,
+		NoCloud:     noCloud,
+		Labels:      o.labels,
+		BindAddress: o.bindAddress,
+	}
+	// Pin the project name in the file too, for compose commands run in dest without -p
+	if dockercompose.SupportsProjectName() {
+		composeOpts.ProjectName = projectName
+	}
+	err = dockercompose.CreateDockerComposeFile(composeOpts)
 	if err != nil {
-		return fmt.Errorf("error changing directory to dest: %w", err)
+		return fmt.Errorf("error creating docker-compose.yml: %w", err)
 	}
+
 	// Launch docker-compose
-	com = exec.Command("docker-compose", "up", "-d")
-	com.Stdout = os.Stdout
-	com.Stderr = os.Stderr
-	// Execute the command
-	if err := com.Run(); err != nil {
-		return fmt.Errorf("error launching docker-compose: %w", err)
+	log.Infof("Launching docker-compose...")
+	log.Command("docker-compose", append([]string{"-p", projectName}, o.composeUpArgs()...)...)
+	launched = true
+	// Image pulls can take minutes, so stream the output and only keep its end for the error
+	composeOutput := newTailBuffer(commandOutputTail)
+	err = dockercompose.Run(projectName, dest,
+		io.MultiWriter(log.Writer(), composeOutput), io.MultiWriter(log.ErrWriter(), composeOutput), o.composeUpArgs()...)
+	if err != nil {
+		if !log.StreamsErrors() {
+			err = fmt.Errorf("%w\n%s", err, composeOutput)
+		}
+		return newCLIError(errorCodeComposeFailed,
+			fmt.Sprintf("the deployment was kept in %s, run docker-compose -p %s down there before removing it", dest, projectName),
+			fmt.Errorf("error launching docker-compose: %w", err))
 	}
 
 	return nil
 }
+
+// commandOutputTail is how much of a failed external command's output is kept for the error.
+const commandOutputTail = 4096
+
+// gitCloneArgs builds the arguments for the git clone of the prod repo.
+// git only reports progress when its stderr is a terminal, so progress asks for it explicitly.
+func (o *cloneOptions) gitCloneArgs(repoUrl, dest string, quiet, progress bool) []string {
+	args := []string{"clone"}
+	if quiet {
+		args = append(args, "--quiet")
+	} else if progress {
+		args = append(args, "--progress")
+	}
+	if o.branch != "" {
+		args = append(args, "--branch", o.branch, "--single-branch")
+	}
+	if o.gitDepth > 0 {
+		args = append(args, "--depth", strconv.Itoa(o.gitDepth))
+	}
+	return append(args, repoUrl, dest)
+}
+
+// webhookSecretBytes is the amount of randomness in a webhook secret.
+// 48 bytes (384 bits) encode to 64 URL-safe base64 characters.
+const webhookSecretBytes = 48
+
+// newWebhookSecret generates the secret used to authenticate calls to the gitops webhook.
+func newWebhookSecret(random io.Reader) (string, error) {
+	b := make([]byte, webhookSecretBytes)
+	if _, err := io.ReadFull(random, b); err != nil {
+		return "", err
+	}
+	return "bs-secrete-webhook-key-" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// composeUpArgs builds the arguments for launching the deployment with docker-compose.
+func (o *cloneOptions) composeUpArgs() []string {
+	args := []string{"up", "-d"}
+	if o.forceRecreate {
+		args = append(args, "--force-recreate")
+	}
+	return args
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// missingTools returns the tools that can't be found on the PATH.
+func missingTools(tools ...string) []string {
+	var missing []string
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
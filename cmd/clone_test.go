@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitCloneArgs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     cloneOptions
+		quiet    bool
+		progress bool
+		expected []string
+	}{
+		{
+			name:     "full clone",
+			opts:     cloneOptions{},
+			expected: []string{"clone", "git@example.com:repo.git", "dest/prod"},
+		},
+		{
+			name:     "shallow clone",
+			opts:     cloneOptions{gitDepth: 1},
+			expected: []string{"clone", "--depth", "1", "git@example.com:repo.git", "dest/prod"},
+		},
+		{
+			name:     "branch",
+			opts:     cloneOptions{branch: "staging", gitDepth: 5},
+			expected: []string{"clone", "--branch", "staging", "--single-branch", "--depth", "5", "git@example.com:repo.git", "dest/prod"},
+		},
+		{
+			name:     "quiet",
+			opts:     cloneOptions{},
+			quiet:    true,
+			progress: true,
+			expected: []string{"clone", "--quiet", "git@example.com:repo.git", "dest/prod"},
+		},
+		{
+			name:     "progress",
+			opts:     cloneOptions{},
+			progress: true,
+			expected: []string{"clone", "--progress", "git@example.com:repo.git", "dest/prod"},
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, tc.opts.gitCloneArgs("git@example.com:repo.git", "dest/prod", tc.quiet, tc.progress), tc.name)
+	}
+}
+
+func TestNewWebhookSecretDeterministic(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, webhookSecretBytes)
+
+	first, err := newWebhookSecret(bytes.NewReader(seed))
+	require.NoError(t, err)
+	second, err := newWebhookSecret(bytes.NewReader(seed))
+	require.NoError(t, err)
+
+	assert.Equal(t, first, second)
+}
+
+func TestNewWebhookSecretShortRead(t *testing.T) {
+	_, err := newWebhookSecret(bytes.NewReader([]byte{0x42}))
+	require.Error(t, err)
+}
+
+func TestNewWebhookSecretFormat(t *testing.T) {
+	secret, err := newWebhookSecret(rand.Reader)
+	require.NoError(t, err)
+
+	require.True(t, strings.HasPrefix(secret, "bs-secrete-webhook-key-"))
+	token := strings.TrimPrefix(secret, "bs-secrete-webhook-key-")
+	assert.Len(t, token, 64)
+	assert.Regexp(t, `^[A-Za-z0-9_-]+$`, token)
+
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	require.NoError(t, err)
+	assert.Len(t, decoded, webhookSecretBytes)
+}
+
+func TestComposeUpArgs(t *testing.T) {
+	assert.Equal(t, []string{"up", "-d"}, (&cloneOptions{}).composeUpArgs())
+	assert.Equal(t, []string{"up", "-d", "--force-recreate"}, (&cloneOptions{forceRecreate: true}).composeUpArgs())
+}
+
+func TestMissingTools(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "git"), []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", dir)
+
+	assert.Equal(t, []string{"docker", "docker-compose"}, missingTools("git", "docker", "docker-compose"))
+	assert.Empty(t, missingTools("git"))
+}
+
+func TestCloneCompletion(t *testing.T) {
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	cmd.SetOut(b)
+	cmd.SetArgs([]string{cobra.ShellCompRequestCmd, "clone", "--tag-strategy", ""})
+
+	require.NoError(t, cmd.Execute())
+	assert.Equal(t, []string{"date", "semver", ":4"}, strings.Split(strings.TrimSpace(b.String()), "\n")[:3])
+}
+
+func TestCloneRejectsEmptyProjectName(t *testing.T) {
+	// Shims that fail, none of them should be reached
+	dir := t.TempDir()
+	for _, tool := range []string{"git", "docker", "docker-compose"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	}
+	t.Setenv("PATH", dir)
+
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	cmd.SetArgs([]string{"clone", "git@example.com:repo.git", filepath.Join(t.TempDir(), "___")})
+	cmd.SetIn(bytes.NewBufferString("no-cloud\n"))
+	cmd.SetOut(b)
+	cmd.SetErr(b)
+
+	assert.Equal(t, 2, execute(cmd))
+	assert.Contains(t, b.String(), "cannot derive a compose project name")
+}
+
+// fakeCloneTools puts shims for git, docker and docker-compose on the PATH and serves the gitops image tags from a fake registry.
+// git creates the directory it clones into and exits with gitExit, docker-compose up exits with composeExit.
+func fakeCloneTools(t *testing.T, gitExit, composeExit string) {
+	t.Helper()
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"git":            "for arg; do dest=$arg; done\nmkdir -p \"$dest\"\necho \"git says " + gitExit + "\" >&2\nexit " + gitExit,
+		"docker":         "exit 0",
+		"docker-compose": "if [ \"$1\" = version ]; then echo 1.29.2; exit 0; fi\necho \"compose says " + composeExit + "\" >&2\nexit " + composeExit,
+	}
+	for tool, script := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	t.Setenv("PATH", dir+":/usr/bin:/bin")
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tags": ["2024-11-git-bbbbbb"]}`))
+	}))
+	t.Cleanup(registry.Close)
+	t.Setenv("BITSWAN_REGISTRY_API", registry.URL)
+	t.Setenv("BITSWAN_CONFIG_DIR", t.TempDir())
+}
+
+// runClone runs clone into dest with the extra flags and returns its exit code and stderr.
+func runClone(t *testing.T, dest string, flags ...string) (int, string) {
+	t.Helper()
+	cmd := newRootCmd("")
+	stderr := bytes.NewBufferString("")
+	cmd.SetArgs(append(append([]string{"clone", "--min-disk", "0"}, flags...), "git@example.com:repo.git", dest))
+	cmd.SetIn(bytes.NewBufferString("no-cloud\n"))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(stderr)
+	return execute(cmd), stderr.String()
+}
+
+func TestCloneRemovesDestinationOnFailure(t *testing.T) {
+	fakeCloneTools(t, "128", "0")
+	dest := filepath.Join(t.TempDir(), "gitops")
+
+	code, stderr := runClone(t, dest)
+	assert.Equal(t, exitCodes[errorCodeCloneFailed], code)
+	assert.NoDirExists(t, dest)
+	// git's stderr is streamed, the error doesn't repeat it
+	assert.Equal(t, "git says 128\nerror executing root command: error cloning repo: exit status 128\n"+
+		"hint: check the repository URL, --branch and your git credentials\n", stderr)
+}
+
+func TestCloneKeepsDestinationWhenComposeFails(t *testing.T) {
+	fakeCloneTools(t, "0", "1")
+	dest := filepath.Join(t.TempDir(), "gitops")
+
+	code, stderr := runClone(t, dest)
+	assert.Equal(t, exitCodes[errorCodeComposeFailed], code)
+	// docker-compose's output was streamed, the error doesn't repeat it
+	assert.Equal(t, 1, strings.Count(stderr, "compose says 1"), stderr)
+	// The compose files are needed to take down whatever docker-compose up created
+	assert.FileExists(t, filepath.Join(dest, "docker-compose.yml"))
+	assert.FileExists(t, filepath.Join(dest, ".env"))
+}
+
+func TestCloneJSONErrors(t *testing.T) {
+	fakeCloneTools(t, "128", "0")
+
+	code, stderr := runClone(t, filepath.Join(t.TempDir(), "gitops"), "--json-errors")
+	assert.Equal(t, exitCodes[errorCodeCloneFailed], code)
+	// stderr holds nothing but the error object
+	var out map[string]map[string]string
+	require.NoError(t, json.Unmarshal([]byte(stderr), &out), stderr)
+	assert.Equal(t, errorCodeCloneFailed, out["error"]["code"])
+	// Nothing was streamed to stderr, so the message carries git's output
+	assert.Equal(t, "error cloning repo: exit status 128\ngit says 128", out["error"]["message"])
+}
+
+func TestCloneQuietReportsComposeOutput(t *testing.T) {
+	fakeCloneTools(t, "0", "1")
+
+	code, stderr := runClone(t, filepath.Join(t.TempDir(), "gitops"), "--quiet")
+	assert.Equal(t, exitCodes[errorCodeComposeFailed], code)
+	// Nothing was streamed, so the error carries the output
+	assert.Contains(t, stderr, "error launching docker-compose: docker-compose up -d failed: exit status 1\ncompose says 1\n")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Error codes reported by --json-errors. They are part of the CLI's interface, don't rename them.
+const (
+	errorCodeUnknown           = "unknown"
+	errorCodeInvalidArgument   = "invalid_argument"
+	errorCodeDockerUnreachable = "docker_unreachable"
+	errorCodeInsufficientDisk  = "insufficient_disk"
+	errorCodeDestinationExists = "destination_exists"
+	errorCodeCloneFailed       = "clone_failed"
+	errorCodeImageLookupFailed = "image_lookup_failed"
+	errorCodeComposeFailed     = "compose_failed"
+	errorCodeProjectExists     = "project_exists"
+	errorCodeMissingTools      = "missing_tools"
+)
+
+// exitCodes gives every error code its own process exit status.
+var exitCodes = map[string]int{
+	errorCodeUnknown:           1,
+	errorCodeInvalidArgument:   2,
+	errorCodeDockerUnreachable: 3,
+	errorCodeInsufficientDisk:  4,
+	errorCodeDestinationExists: 5,
+	errorCodeCloneFailed:       6,
+	errorCodeImageLookupFailed: 7,
+	errorCodeComposeFailed:     8,
+	errorCodeProjectExists:     9,
+	errorCodeMissingTools:      10,
+}
+
+// cliError attaches an error code and a remediation hint to an error.
+type cliError struct {
+	code string
+	hint string
+	err  error
+}
+
+func newCLIError(code, hint string, err error) error {
+	return &cliError{code: code, hint: hint, err: err}
+}
+
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cliError) Unwrap() error {
+	return e.err
+}
+
+// errorDetails returns the code and hint of err, errorCodeUnknown if it has none.
+func errorDetails(err error) (string, string) {
+	var ce *cliError
+	if errors.As(err, &ce) {
+		return ce.code, ce.hint
+	}
+	return errorCodeUnknown, ""
+}
+
+func exitCode(err error) int {
+	code, _ := errorDetails(err)
+	return exitCodes[code]
+}
+
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// writeJSONError writes err as a single {"error": {...}} JSON object.
+func writeJSONError(w io.Writer, err error) error {
+	code, hint := errorDetails(err)
+	return json.NewEncoder(w).Encode(map[string]jsonError{
+		"error": {Code: code, Message: err.Error(), Hint: hint},
+	})
+}
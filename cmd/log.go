@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// logLevel controls how much progress output a command prints.
+type logLevel int
+
+const (
+	levelQuiet logLevel = iota
+	levelNormal
+	levelVerbose
+)
+
+// logger prints progress messages that are at or below its level.
+type logger struct {
+	out        io.Writer
+	errOut     io.Writer
+	level      logLevel
+	jsonErrors bool
+}
+
+// newLogger returns a logger writing progress to the command's stdout and warnings to its stderr,
+// at the level picked with --quiet/--verbose. With --json-errors stderr is kept for the error object,
+// so warnings go to stdout too.
+func newLogger(cmd *cobra.Command) *logger {
+	level := levelNormal
+	if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
+		level = levelQuiet
+	}
+	if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
+		level = levelVerbose
+	}
+	jsonErrors, _ := cmd.Flags().GetBool("json-errors")
+	errOut := cmd.ErrOrStderr()
+	if jsonErrors {
+		errOut = cmd.OutOrStdout()
+	}
+	return &logger{out: cmd.OutOrStdout(), errOut: errOut, level: level, jsonErrors: jsonErrors}
+}
+
+// Infof prints a progress message unless --quiet is set.
+func (l *logger) Infof(format string, args ...interface{}) {
+	if l.level >= levelNormal {
+		fmt.Fprintf(l.out, format+"\n", args...)
+	}
+}
+
+// ErrWriter returns where warnings and the stderr of external commands should go, nowhere if --quiet is set.
+func (l *logger) ErrWriter() io.Writer {
+	if l.level >= levelNormal {
+		return l.errOut
+	}
+	return io.Discard
+}
+
+// Command prints a command line that is about to run when --verbose is set.
+func (l *logger) Command(name string, args ...string) {
+	if l.level >= levelVerbose {
+		fmt.Fprintf(l.out, "+ %s %s\n", name, strings.Join(args, " "))
+	}
+}
+
+// Writer returns where the output of external commands should go, nowhere if --quiet is set.
+func (l *logger) Writer() io.Writer {
+	if l.level >= levelNormal {
+		return l.out
+	}
+	return io.Discard
+}
+
+// StreamsErrors reports whether the stderr of external commands reaches the user's stderr as it is written.
+// When it doesn't, errors about those commands should carry their output.
+func (l *logger) StreamsErrors() bool {
+	return l.level >= levelNormal && !l.jsonErrors
+}
+
+// Quiet reports whether only errors should be printed.
+func (l *logger) Quiet() bool {
+	return l.level == levelQuiet
+}
+
+// tailBuffer keeps the last max bytes written to it, for reporting the output of a failed external command.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	testCases := []struct {
+		name     string
+		flags    []string
+		expected string
+		warnings string
+	}{
+		{
+			name:     "quiet",
+			flags:    []string{"--quiet"},
+			expected: "",
+		},
+		{
+			name:     "normal",
+			flags:    nil,
+			expected: "cloning\noutput\n",
+			warnings: "Warning: low disk\n",
+		},
+		{
+			name:     "verbose",
+			flags:    []string{"-v"},
+			expected: "cloning\n+ git clone repo\noutput\n",
+			warnings: "Warning: low disk\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		cmd := newRootCmd("")
+		b := bytes.NewBufferString("")
+		warnings := bytes.NewBufferString("")
+		cmd.SetOut(b)
+		cmd.SetErr(warnings)
+		require.NoError(t, cmd.ParseFlags(tc.flags), tc.name)
+
+		log := newLogger(cmd)
+		log.Infof("cloning")
+		log.Command("git", "clone", "repo")
+		log.Writer().Write([]byte("output\n"))
+		log.ErrWriter().Write([]byte("Warning: low disk\n"))
+
+		assert.Equal(t, tc.expected, b.String(), tc.name)
+		assert.Equal(t, tc.warnings, warnings.String(), tc.name)
+	}
+}
+
+func TestLoggerJSONErrors(t *testing.T) {
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	stderr := bytes.NewBufferString("")
+	cmd.SetOut(b)
+	cmd.SetErr(stderr)
+	require.NoError(t, cmd.ParseFlags([]string{"--json-errors"}))
+
+	newLogger(cmd).ErrWriter().Write([]byte("Warning: low disk\n"))
+
+	assert.Equal(t, "Warning: low disk\n", b.String())
+	assert.Empty(t, stderr.String())
+}
+
+func TestQuietAndVerboseAreExclusive(t *testing.T) {
+	cmd := newRootCmd("")
+	cmd.SetArgs([]string{"version", "--quiet", "--verbose"})
+	cmd.SetOut(bytes.NewBufferString(""))
+
+	require.Error(t, cmd.Execute())
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := newTailBuffer(8)
+	tail.Write([]byte("pulling layer 1\n"))
+	tail.Write([]byte("failed\n"))
+
+	assert.Equal(t, "failed", tail.String())
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// expandPath expands a leading ~ or ~user and returns the cleaned absolute path.
+// Shells only expand ~ when it is unquoted, so paths handed over as "~/x" or --flag=~/x arrive verbatim.
+func expandPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		name, rest, _ := strings.Cut(path[1:], "/")
+		var home string
+		if name == "" {
+			dir, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("error expanding %s: %w", path, err)
+			}
+			home = dir
+		} else {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", fmt.Errorf("error expanding %s: %w", path, err)
+			}
+			home = u.HomeDir
+		}
+		path = filepath.Join(home, rest)
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "home",
+			path:     "~",
+			expected: home,
+		},
+		{
+			name:     "inside home",
+			path:     "~/deployments/../gitops",
+			expected: filepath.Join(home, "gitops"),
+		},
+		{
+			name:     "relative",
+			path:     "gitops",
+			expected: filepath.Join(cwd, "gitops"),
+		},
+		{
+			name:     "absolute",
+			path:     "/srv//gitops/",
+			expected: "/srv/gitops",
+		},
+	}
+
+	for _, tc := range testCases {
+		expanded, err := expandPath(tc.path)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.expected, expanded, tc.name)
+	}
+}
+
+func TestExpandPathOtherUser(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	expanded, err := expandPath("~" + current.Username + "/gitops")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(current.HomeDir, "gitops"), expanded)
+
+	_, err = expandPath("~no-such-user-bitswan/gitops")
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -10,22 +11,86 @@ func newRootCmd(version string) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "bitswan-gitops",
 		Short: "Deploy your pipelines to a CRE with bitswan-gitops",
+		Long: `bitswan-gitops sets up and manages bitswan-gitops deployments.
+
+A deployment is a directory holding a production and a development
+checkout of your pipelines repository together with the docker-compose
+setup that runs the gitops service against the production checkout.`,
+		SilenceUsage:               true,
+		SilenceErrors:              true,
+		SuggestionsMinimumDistance: 2,
+		Args:                       invalidArgs(unknownCommand),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// cobra checks flag groups itself too, but its error carries no code
+			if err := cmd.ValidateFlagGroups(); err != nil {
+				return newCLIError(errorCodeInvalidArgument, "", err)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return cmd.Help()
 		},
 	}
 
+	cmd.PersistentFlags().Bool("json-errors", false, "Report failures as a single JSON object on stderr, anything else printed there goes to stdout instead")
+	cmd.PersistentFlags().BoolP("quiet", "q", false, "Only print errors")
+	cmd.PersistentFlags().BoolP("verbose", "v", false, "Also print the external commands being run")
+	cmd.MarkFlagsMutuallyExclusive("quiet", "verbose")
+	cmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return newCLIError(errorCodeInvalidArgument, "", err)
+	})
+
 	cmd.AddCommand(newVersionCmd(version)) // version subcommand
 	cmd.AddCommand(newCloneCmd())
 
 	return cmd
 }
 
-// Execute invokes the command.
-func Execute(version string) error {
-	if err := newRootCmd(version).Execute(); err != nil {
-		return fmt.Errorf("error executing root command: %w", err)
+// invalidArgs reports the errors of the positional argument check validate as invalid arguments.
+func invalidArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return newCLIError(errorCodeInvalidArgument, "", err)
+		}
+		return nil
+	}
+}
+
+// unknownCommand rejects any argument to a command that only dispatches to subcommands, the way cobra does by default.
+func unknownCommand(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("unknown command %q for %q", args[0], cmd.CommandPath())
+	if suggestions := cmd.SuggestionsFor(args[0]); len(suggestions) > 0 {
+		msg += "\n\nDid you mean this?\n"
+		for _, suggestion := range suggestions {
+			msg += "\t" + suggestion + "\n"
+		}
+	}
+	return errors.New(msg)
+}
+
+// execute runs cmd, reports any error on its stderr and returns the process exit code.
+func execute(cmd *cobra.Command) int {
+	err := cmd.Execute()
+	if err == nil {
+		return 0
 	}
 
-	return nil
+	if jsonErrors, _ := cmd.PersistentFlags().GetBool("json-errors"); jsonErrors {
+		writeJSONError(cmd.ErrOrStderr(), err)
+	} else {
+		fmt.Fprintf(cmd.ErrOrStderr(), "error executing root command: %v\n", err)
+		if _, hint := errorDetails(err); hint != "" {
+			fmt.Fprintf(cmd.ErrOrStderr(), "hint: %s\n", hint)
+		}
+	}
+
+	return exitCode(err)
+}
+
+// Execute invokes the command and returns the process exit code.
+func Execute(version string) int {
+	return execute(newRootCmd(version))
 }
@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,3 +20,80 @@ func TestRootCommandOutput(t *testing.T) {
 	cmdErr := cmd.RunE(cmd, nil)
 	require.NoError(t, cmdErr)
 }
+
+func TestRootCommandUnknownSubcommand(t *testing.T) {
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+
+	cmd.SetArgs([]string{"clon"})
+	cmd.SetOut(b)
+	cmd.SetErr(b)
+
+	cmdErr := cmd.Execute()
+	require.Error(t, cmdErr)
+	require.Contains(t, cmdErr.Error(), `unknown command "clon"`)
+	require.Contains(t, cmdErr.Error(), "Did you mean this?")
+	require.Empty(t, b.String())
+}
+
+func TestExecuteReportsErrorCode(t *testing.T) {
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+
+	cmd.SetArgs([]string{"version", "--no-such-flag"})
+	cmd.SetOut(b)
+	cmd.SetErr(b)
+
+	assert.Equal(t, 2, execute(cmd))
+	assert.Contains(t, b.String(), "error executing root command: unknown flag: --no-such-flag")
+}
+
+func TestExecuteJSONErrors(t *testing.T) {
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+
+	cmd.SetArgs([]string{"--json-errors", "clone", "--git-depth", "-1", "repo"})
+	cmd.SetIn(bytes.NewBufferString("no-cloud\n"))
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(b)
+
+	assert.Equal(t, 2, execute(cmd))
+
+	var out map[string]map[string]string
+	require.NoError(t, json.Unmarshal(b.Bytes(), &out))
+	assert.Equal(t, errorCodeInvalidArgument, out["error"]["code"])
+	assert.Equal(t, "--git-depth must not be negative: -1", out["error"]["message"])
+}
+
+func TestExecuteInvalidArguments(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "missing repo argument",
+			args: []string{"--json-errors", "clone"},
+		},
+		{
+			name: "unknown subcommand",
+			args: []string{"--json-errors", "clon"},
+		},
+		{
+			name: "quiet and verbose",
+			args: []string{"--json-errors", "version", "--quiet", "--verbose"},
+		},
+	}
+
+	for _, tc := range testCases {
+		cmd := newRootCmd("")
+		b := bytes.NewBufferString("")
+		cmd.SetArgs(tc.args)
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(b)
+
+		assert.Equal(t, 2, execute(cmd), tc.name)
+		var out map[string]map[string]string
+		require.NoError(t, json.Unmarshal(b.Bytes(), &out), tc.name)
+		assert.Equal(t, errorCodeInvalidArgument, out["error"]["code"], tc.name)
+	}
+}
@@ -10,7 +10,7 @@ func newVersionCmd(version string) *cobra.Command {
 	return &cobra.Command{
 		Use:          "version",
 		Short:        "bitswan-gitops version",
-		Args:         cobra.NoArgs,
+		Args:         invalidArgs(cobra.NoArgs),
 		SilenceUsage: true,
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Fprintf(cmd.OutOrStdout(), "bitswan-gitops: %s\n", version)
@@ -0,0 +1,14 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Dir returns bitswan's configuration directory: $BITSWAN_CONFIG_DIR if set, otherwise ~/.config/bitswan.
+func Dir() string {
+	if dir := os.Getenv("BITSWAN_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "bitswan")
+}
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDir(t *testing.T) {
+	t.Setenv("HOME", "/home/bitswan")
+	t.Setenv("BITSWAN_CONFIG_DIR", "")
+	assert.Equal(t, "/home/bitswan/.config/bitswan", Dir())
+
+	// XDG_CONFIG_HOME doesn't move the documented default
+	t.Setenv("XDG_CONFIG_HOME", "/xdg")
+	assert.Equal(t, "/home/bitswan/.config/bitswan", Dir())
+
+	t.Setenv("BITSWAN_CONFIG_DIR", "/srv/bitswan")
+	assert.Equal(t, "/srv/bitswan", Dir())
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package diskspace
+
+import "errors"
+
+// Available is not implemented on this platform, Check skips the disk space check.
+func Available(path string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package diskspace
+
+import "syscall"
+
+// Available returns the number of bytes available to unprivileged users on the filesystem holding path.
+func Available(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package diskspace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvailable(t *testing.T) {
+	_, err := Available(t.TempDir())
+	require.NoError(t, err)
+}
@@ -0,0 +1,35 @@
+package diskspace
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const GiB = 1024 * 1024 * 1024
+
+// available measures free space for Check, tests swap it for a fake.
+var available = Available
+
+// Check returns an error if the filesystem holding the docker data root rootDir has less than minGiB free.
+// If the data root is not visible from this host (for example docker running in a VM) the check is skipped
+// with a warning written to warnings.
+func Check(rootDir string, minGiB int, warnings io.Writer) error {
+	if minGiB <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(rootDir); err != nil {
+		fmt.Fprintf(warnings, "Warning: cannot check free space of docker data root %s: %v\n", rootDir, err)
+		return nil
+	}
+	free, err := available(rootDir)
+	if err != nil {
+		fmt.Fprintf(warnings, "Warning: cannot check free space of docker data root %s: %v\n", rootDir, err)
+		return nil
+	}
+	if free < uint64(minGiB)*GiB {
+		return fmt.Errorf("not enough disk space for docker images: %.1f GiB available in %s, at least %d GiB required (see --min-disk)",
+			float64(free)/GiB, rootDir, minGiB)
+	}
+	return nil
+}
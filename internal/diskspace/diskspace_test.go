@@ -0,0 +1,49 @@
+package diskspace
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAvailable makes Check see free bytes of free space, or err.
+func fakeAvailable(t *testing.T, free uint64, err error) {
+	t.Helper()
+	original := available
+	available = func(string) (uint64, error) { return free, err }
+	t.Cleanup(func() { available = original })
+}
+
+func TestCheck(t *testing.T) {
+	rootDir := t.TempDir()
+	fakeAvailable(t, 3*GiB, nil)
+
+	warnings := bytes.NewBufferString("")
+	require.NoError(t, Check(rootDir, 0, warnings))
+	require.NoError(t, Check(rootDir, 3, warnings))
+	assert.Empty(t, warnings.String())
+
+	err := Check(rootDir, 4, warnings)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough disk space for docker images: 3.0 GiB available")
+	assert.Contains(t, err.Error(), rootDir)
+}
+
+func TestCheckFreeSpaceUnknown(t *testing.T) {
+	fakeAvailable(t, 0, errors.New("not supported"))
+
+	warnings := bytes.NewBufferString("")
+	require.NoError(t, Check(t.TempDir(), 4, warnings))
+	assert.Contains(t, warnings.String(), "not supported")
+}
+
+func TestCheckDataRootNotVisible(t *testing.T) {
+	// docker running in a VM reports a data root that doesn't exist on this host
+	warnings := bytes.NewBufferString("")
+	require.NoError(t, Check(filepath.Join(t.TempDir(), "missing"), 1<<30, warnings))
+	assert.Contains(t, warnings.String(), "Warning: cannot check free space of docker data root")
+}
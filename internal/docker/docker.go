@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	exec "os/exec"
+	"strings"
+)
+
+// ErrDaemonUnreachable is returned when the docker CLI cannot reach a docker daemon.
+var ErrDaemonUnreachable = errors.New("Docker daemon is not running or not accessible")
+
+// CheckDaemon makes sure the docker CLI can talk to a docker daemon.
+func CheckDaemon() error {
+	out, err := exec.Command("docker", "info", "--format", "{{.ServerVersion}}").CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "Cannot connect to the Docker daemon") ||
+		strings.Contains(string(out), "permission denied while trying to connect to the Docker daemon") {
+		return ErrDaemonUnreachable
+	}
+	return fmt.Errorf("error running docker info: %w: %s", err, strings.TrimSpace(string(out)))
+}
+
+// RootDir asks the docker daemon where it keeps its images.
+func RootDir() (string, error) {
+	out, err := exec.Command("docker", "info", "--format", "{{.DockerRootDir}}").Output()
+	if err != nil {
+		return "", fmt.Errorf("error running docker info: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ProjectContainers lists the names of all containers, running or not, that belong to the compose project.
+func ProjectContainers(project string) ([]string, error) {
+	out, err := exec.Command("docker", "ps", "-a",
+		"--filter", "label=com.docker.compose.project="+project,
+		"--format", "{{.Names}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers of compose project %s: %w", project, err)
+	}
+	return strings.Fields(string(out)), nil
+}
@@ -1,85 +1,46 @@
 package dockercompose
 
 import (
-	"gopkg.in/yaml.v3"
-	"os"
-)
+	"fmt"
+	"io"
+	exec "os/exec"
+	"strconv"
+	"strings"
 
-func CreateDockerComposeFile(dest, latestVersion, creDir string, noCloud bool) error {
-	destFullPath := os.Getenv("PWD") + "/" + dest
-	sshDir := os.Getenv("HOME") + "/.ssh"
-	if creDir == "" {
-		creDir = "cre-01"
-	}
+	"github.com/bitswan-space/bitswan-gitops/pkg/compose"
+)
 
-	// Construct the docker-compose data structure
-	dockerCompose := map[string]interface{}{
-		"version": "3.8",
-		"services": map[string]interface{}{
-			"bitswan_gitops": map[string]interface{}{
-				"image": "bitswan/pipeline-runtime-environment:" + latestVersion,
-				"volumes": []string{
-					"/etc/bitswan-secrets/:/etc/bitswan-secrets/",
-					destFullPath + "/prod:/repo/",
-					sshDir + ":/root/.ssh",
-					"/var/run/docker.sock:/var/run/docker.sock",
-				},
-				"environment": map[string]string{
-					"BS_WEBHOOK_PORT": "8000",
-					"BS_CRE_DIR":      "/repo/" + creDir,
-					"BS_BITSWAN_DIR":  "/repo/" + creDir,
-				},
-				"env_file": []string{destFullPath + "/.env"},
-			},
-		},
-	}
+// ComposeOptions describes the deployment a docker-compose file is generated for.
+type ComposeOptions = compose.Options
 
-	if noCloud {
-		addMosquitoToDockercompose(dockerCompose, destFullPath)
-	}
+func CreateDockerComposeFile(opts ComposeOptions) error {
+	return compose.CreateDockerComposeFile(opts)
+}
 
-	// Open the docker-compose.yml file for writing
-	dcf, err := os.Create(dest + "/docker-compose.yml")
-	if err != nil {
-		return err
-	}
-	defer dcf.Close()
+func ProjectName(dest string) string {
+	return compose.ProjectName(dest)
+}
 
-	// Serialize the docker-compose data structure to YAML and write it to the file
-	encoder := yaml.NewEncoder(dcf)
-	encoder.SetIndent(2) // Optional: Set indentation
-	err = encoder.Encode(dockerCompose)
+// SupportsProjectName reports whether the installed docker-compose accepts a top-level name in docker-compose.yml.
+// docker-compose 1.x rejects it, so anything that isn't clearly compose v2 or later is treated as unsupported.
+func SupportsProjectName() bool {
+	out, err := exec.Command("docker-compose", "version", "--short").Output()
 	if err != nil {
-		return err
+		return false
 	}
-
-	return nil
+	major, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(string(out)), "v"), ".")
+	version, err := strconv.Atoi(major)
+	return err == nil && version >= 2
 }
 
-func addMosquitoToDockercompose(composeMap map[string]interface{}, dest string) {
-	composeMap["services"].(map[string]interface{})["mosquitto"] = map[string]interface{}{
-		"image": "eclipse-mosquitto",
-		"ports": []string{"1883:1883"},
-		"restart": "always",
-		"volumes": []string{"mosquitto:/mosquitto", dest+"/mosquitto.conf:/mosquitto/config/mosquitto.conf"},
-	}
-	if _, ok := composeMap["volumes"]; !ok {
-		composeMap["volumes"] = map[string]interface{}{}
-	}
-	composeMap["volumes"].(map[string]interface{})["mosquitto"] = map[string]interface{}{}
-	mosquitoConf := `persistence true
-persistence_location /mosquitto/data/
-log_dest file /mosquitto/log/mosquitto.log
-allow_anonymous true
-
-# MQTT listener
-listener 1883
-protocol mqtt
-`
-	mosquittoConfFile, err := os.Create(dest + "/mosquitto.conf")
-	if err != nil {
-		panic(err)
+// Run runs docker-compose for the project in dir, streaming its output to stdout and stderr.
+func Run(projectName, dir string, stdout, stderr io.Writer, args ...string) error {
+	com := exec.Command("docker-compose", append([]string{"-p", projectName}, args...)...)
+	com.Dir = dir
+	com.Stdout = stdout
+	com.Stderr = stderr
+	if err := com.Run(); err != nil {
+		return fmt.Errorf("docker-compose %s failed: %w", strings.Join(args, " "), err)
 	}
-	defer mosquittoConfFile.Close()
-	_, err = mosquittoConfFile.WriteString(mosquitoConf)
+	return nil
 }
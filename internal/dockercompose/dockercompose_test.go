@@ -0,0 +1,71 @@
+package dockercompose
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDockerCompose puts a docker-compose on the PATH that prints its working directory and arguments.
+func fakeDockerCompose(t *testing.T, exitCode string) {
+	t.Helper()
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$PWD $*\"\necho oops >&2\nexit " + exitCode + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker-compose"), []byte(script), 0755))
+	t.Setenv("PATH", bin)
+}
+
+func TestRun(t *testing.T) {
+	fakeDockerCompose(t, "0")
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+
+	stdout, stderr := bytes.NewBufferString(""), bytes.NewBufferString("")
+	require.NoError(t, Run("gitops", dir, stdout, stderr, "up", "-d"))
+	assert.Equal(t, dir+" -p gitops up -d\n", stdout.String())
+	assert.Equal(t, "oops\n", stderr.String())
+}
+
+func TestRunFailure(t *testing.T) {
+	fakeDockerCompose(t, "3")
+
+	err := Run("gitops", t.TempDir(), io.Discard, io.Discard, "up", "-d")
+	require.Error(t, err)
+	assert.Equal(t, "docker-compose up -d failed: exit status 3", err.Error())
+}
+
+func TestSupportsProjectName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		script   string
+		expected bool
+	}{
+		{
+			name:     "compose v1",
+			script:   "echo 1.29.2",
+			expected: false,
+		},
+		{
+			name:     "compose v2",
+			script:   "echo v2.24.6",
+			expected: true,
+		},
+		{
+			name:     "version not readable",
+			script:   "exit 1",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		bin := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(bin, "docker-compose"), []byte("#!/bin/sh\n"+tc.script+"\n"), 0755))
+		t.Setenv("PATH", bin)
+		assert.Equal(t, tc.expected, SupportsProjectName(), tc.name)
+	}
+}
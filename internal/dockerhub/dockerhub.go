@@ -3,35 +3,308 @@ package dockerhub
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/bitswan-space/bitswan-gitops/internal/config"
+)
+
+const bitswanGitopsRepository = "bitswan/pipeline-runtime-environment"
+
+// bitswanGitopsTagsUrl lists the tags of the bitswan-gitops image, tests point it at a fake server.
+// It asks for DockerHub's largest page size to keep the number of requests down.
+var bitswanGitopsTagsUrl = "https://hub.docker.com/v2/repositories/" + bitswanGitopsRepository + "/tags/?page_size=100"
+
+var (
+	// Retries is how often a failed DockerHub or registry request is retried, tests set it to zero.
+	Retries = 2
+	// Client is used for all DockerHub and registry requests.
+	Client = &http.Client{Timeout: 10 * time.Second}
+	// initialBackoff is the wait before the first retry, it doubles with every further attempt.
+	initialBackoff = 500 * time.Millisecond
+)
+
+const (
+	// maxRetryAfter caps how long we wait for a rate limit to reset.
+	maxRetryAfter = time.Minute
+	// maxTagPages caps how many pages of tags are read before picking the latest version.
+	maxTagPages = 10
+	// defaultCacheTTL is how long a resolved tag is reused, override with BITSWAN_DOCKERHUB_CACHE_TTL.
+	defaultCacheTTL = time.Hour
+)
+
+type tag struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+type tagsResponse struct {
+	Next    string `json:"next"`
+	Results []tag  `json:"results"`
+}
+
+type cacheEntry struct {
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// TagStrategy decides which of an image's tags is the latest one.
+type TagStrategy string
+
+const (
+	// TagStrategyDate picks the newest YYYY-N-git-SHA tag by its year and build number.
+	TagStrategyDate TagStrategy = "date"
+	// TagStrategySemver picks the highest MAJOR.MINOR.PATCH tag, pre-releases are ignored.
+	TagStrategySemver TagStrategy = "semver"
 )
 
-func GetLatestBitswanGitopsVersion() (string, error) {
-	// Get the latest version of the bitswan-gitops image by looking it up on dockerhub
-	getLatestVersionUrl := "https://hub.docker.com/v2/repositories/bitswan/pipeline-runtime-environment/tags/"
-	resp, err := http.Get(getLatestVersionUrl)
+var tagPatterns = map[TagStrategy]*regexp.Regexp{
+	TagStrategyDate:   regexp.MustCompile(`^(\d{4})-(\d+)-git-[a-fA-F0-9]+$`),
+	TagStrategySemver: regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)$`),
+}
+
+// ParseTagStrategy validates a tag strategy name.
+func ParseTagStrategy(name string) (TagStrategy, error) {
+	strategy := TagStrategy(name)
+	if _, ok := tagPatterns[strategy]; !ok {
+		return "", fmt.Errorf("unknown tag strategy %q, use %q or %q", name, TagStrategyDate, TagStrategySemver)
+	}
+	return strategy, nil
+}
+
+// LookupOptions controls how the latest image version is resolved.
+type LookupOptions struct {
+	// Registry is the registry API URL to query, see RegistryAPI.
+	Registry string
+	// Strategy decides which tag is the latest, TagStrategyDate if empty.
+	Strategy TagStrategy
+	// Refresh ignores the cached result and asks the registry again.
+	Refresh bool
+	// RequireDigest asks the registry again if the cached result has no digest.
+	RequireDigest bool
+	// Warnings receives problems that don't stop the lookup, they are dropped if nil.
+	Warnings io.Writer
+}
+
+// GetLatestBitswanGitopsImage returns the latest version of the bitswan-gitops image along with its digest.
+// The image is looked up on DockerHub unless a registry API URL is given, see RegistryAPI.
+// Results are cached on disk so repeated runs don't run into rate limits.
+func GetLatestBitswanGitopsImage(opts LookupOptions) (string, string, error) {
+	registry := RegistryAPI(opts.Registry)
+	strategy := opts.Strategy
+	if strategy == "" {
+		strategy = TagStrategyDate
+	}
+	url := bitswanGitopsTagsUrl
+	lookup := func() (tag, error) { return getLatestTag(url, strategy) }
+	if registry != "" {
+		api, repository, err := registryRepository(registry)
+		if err != nil {
+			return "latest", "", err
+		}
+		url = registryTagsUrl(api.String(), repository)
+		lookup = func() (tag, error) {
+			return getLatestRegistryTag(api.String(), repository, strategy, opts.RequireDigest)
+		}
+	}
+
+	cacheKey := url + "#" + string(strategy)
+	cache := readCache()
+	if entry, ok := cache[cacheKey]; ok && !opts.Refresh && time.Since(entry.ResolvedAt) < cacheTTL() &&
+		(entry.Digest != "" || !opts.RequireDigest) {
+		return entry.Tag, entry.Digest, nil
+	}
+
+	latest, err := lookup()
+	if err != nil {
+		return "latest", "", err
+	}
+
+	cache[cacheKey] = cacheEntry{Tag: latest.Name, Digest: latest.Digest, ResolvedAt: time.Now()}
+	if err := writeCache(cache); err != nil && opts.Warnings != nil {
+		fmt.Fprintf(opts.Warnings, "Warning: could not cache the image version lookup: %v\n", err)
+	}
+	return latest.Name, latest.Digest, nil
+}
+
+func getLatestTag(url string, strategy TagStrategy) (tag, error) {
+	// Get the latest version of the bitswan-gitops image by looking it up on dockerhub.
+	// Tags are paginated and the listing order can't be trusted, so read every page before picking one.
+	var tags []tag
+	for page := 0; page < maxTagPages && url != ""; page++ {
+		body, _, err := get(http.MethodGet, url, "")
+		if err != nil {
+			return tag{}, err
+		}
+		var data tagsResponse
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			return tag{}, err
+		}
+		tags = append(tags, data.Results...)
+		url = data.Next
+	}
+	latest, ok := selectLatest(tags, strategy)
+	if !ok {
+		return tag{}, errors.New("No valid version found")
+	}
+	return latest, nil
+}
+
+// selectLatest returns the highest of the tags matching strategy, regardless of the order DockerHub lists them in.
+func selectLatest(tags []tag, strategy TagStrategy) (tag, bool) {
+	pattern := tagPatterns[strategy]
+	var latest tag
+	var latestKey []int
+	for _, t := range tags {
+		match := pattern.FindStringSubmatch(t.Name)
+		if match == nil {
+			continue
+		}
+		key := make([]int, len(match)-1)
+		for i, part := range match[1:] {
+			key[i], _ = strconv.Atoi(part)
+		}
+		if latestKey == nil || compareKeys(key, latestKey) > 0 {
+			latest, latestKey = t, key
+		}
+	}
+	return latest, latestKey != nil
+}
+
+func compareKeys(a, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] > b[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// unauthorizedError is returned for a 401 response, challenge holds its WWW-Authenticate header.
+type unauthorizedError struct {
+	url       string
+	status    string
+	challenge string
+}
+
+func (e *unauthorizedError) Error() string {
+	return fmt.Sprintf("unexpected response from %s: %s", e.url, e.status)
+}
+
+// get sends a request, retrying with exponential backoff on network errors, rate limiting and server errors.
+// A non-empty authorization is sent as the Authorization header.
+func get(method, url, authorization string) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		body, header, wait, err := getOnce(method, url, authorization, attempt)
+		if err == nil {
+			return body, header, nil
+		}
+		if wait < 0 || attempt >= Retries {
+			return nil, nil, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// getOnce sends a single request. On failure it also returns how long to wait before trying again,
+// negative if the request shouldn't be retried.
+func getOnce(method, url, authorization string, attempt int) ([]byte, http.Header, time.Duration, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if method == http.MethodHead {
+		req.Header.Set("Accept", manifestMediaTypes)
+	}
+	resp, err := Client.Do(req)
 	if err != nil {
-		return "latest", err
+		return nil, nil, backoff(attempt), err
 	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, nil, retryAfter(resp.Header.Get("Retry-After"), attempt), fmt.Errorf("rate limited by %s: %s", url, resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, nil, -1, &unauthorizedError{url: url, status: resp.Status, challenge: resp.Header.Get("WWW-Authenticate")}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, nil, backoff(attempt), fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, -1, fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "latest", err
+		return nil, nil, backoff(attempt), err
+	}
+	return body, resp.Header, 0, nil
+}
+
+func backoff(attempt int) time.Duration {
+	return initialBackoff << attempt
+}
+
+// retryAfter parses a Retry-After header, falling back to exponential backoff when it's missing or invalid.
+func retryAfter(header string, attempt int) time.Duration {
+	wait := backoff(attempt)
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
 	}
-	var data map[string]interface{}
-	err = json.Unmarshal(body, &data)
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+func cachePath() string {
+	return filepath.Join(config.Dir(), "cache", "dockerhub.json")
+}
+
+func cacheTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("BITSWAN_DOCKERHUB_CACHE_TTL")); err == nil {
+		return ttl
+	}
+	return defaultCacheTTL
+}
+
+// readCache returns the cached lookups keyed by tags URL. A missing or unreadable cache is treated as empty.
+func readCache() map[string]cacheEntry {
+	cache := map[string]cacheEntry{}
+	data, err := os.ReadFile(cachePath())
 	if err != nil {
-		return "latest", err
+		return cache
 	}
-	results := data["results"].([]interface{})
-	pattern := `^\d{4}-\d+-git-[a-fA-F0-9]+$`
-	for _, result := range results {
-		tag := result.(map[string]interface{})["name"].(string)
-		if match, _ := regexp.MatchString(pattern, tag); match {
-			return tag, nil
-		}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return map[string]cacheEntry{}
+	}
+	return cache
+}
+
+func writeCache(cache map[string]cacheEntry) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath()), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
 	}
-	return "latest", errors.New("No valid version found")
+	return os.WriteFile(cachePath(), data, 0644)
 }
@@ -0,0 +1,251 @@
+package dockerhub
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tagsPage = `{"results": [
+	{"name": "latest", "digest": "sha256:aaa"},
+	{"name": "2024-12-git-abcdef", "digest": "sha256:bbb"}
+]}`
+
+// fakeDockerHub serves responses in order and points the lookup at it with an empty cache.
+func fakeDockerHub(t *testing.T, handlers ...http.HandlerFunc) *int {
+	t.Helper()
+	t.Setenv("BITSWAN_CONFIG_DIR", t.TempDir())
+	t.Setenv("BITSWAN_REGISTRY_API", "")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Less(t, requests, len(handlers), "unexpected request to %s", r.URL) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		handlers[requests](w, r)
+		requests++
+	}))
+	t.Cleanup(server.Close)
+
+	originalUrl, originalBackoff := bitswanGitopsTagsUrl, initialBackoff
+	bitswanGitopsTagsUrl, initialBackoff = server.URL+"/tags/", time.Millisecond
+	t.Cleanup(func() { bitswanGitopsTagsUrl, initialBackoff = originalUrl, originalBackoff })
+	return &requests
+}
+
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func TestGetLatestBitswanGitopsImage(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusOK, tagsPage))
+
+	version, digest, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, "sha256:bbb", digest)
+
+	// The second lookup is answered from the cache
+	version, digest, err = GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, "sha256:bbb", digest)
+	assert.Equal(t, 1, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageCacheNotWritable(t *testing.T) {
+	fakeDockerHub(t, respond(http.StatusOK, tagsPage))
+	// A file where the config directory should be
+	configDir := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(configDir, nil, 0644))
+	t.Setenv("BITSWAN_CONFIG_DIR", configDir)
+
+	warnings := bytes.NewBufferString("")
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{Warnings: warnings})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Contains(t, warnings.String(), "Warning: could not cache the image version lookup")
+}
+
+func TestGetLatestBitswanGitopsImageCacheExpired(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusOK, tagsPage), respond(http.StatusOK, tagsPage))
+	t.Setenv("BITSWAN_DOCKERHUB_CACHE_TTL", "0s")
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	_, _, err = GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageRefresh(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusOK, tagsPage), respond(http.StatusOK, `{"results": [{"name": "2025-1-git-fedcba", "digest": "sha256:ddd"}]}`))
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{Refresh: true})
+	require.NoError(t, err)
+	assert.Equal(t, "2025-1-git-fedcba", version)
+	assert.Equal(t, 2, *requests)
+
+	// The refreshed result replaces the cached one
+	version, _, err = GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2025-1-git-fedcba", version)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageRateLimited(t *testing.T) {
+	rateLimited := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	requests := fakeDockerHub(t, rateLimited, rateLimited, respond(http.StatusOK, tagsPage))
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageNoValidVersion(t *testing.T) {
+	fakeDockerHub(t, respond(http.StatusOK, `{"results": [{"name": "latest"}]}`))
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.Error(t, err)
+	assert.Equal(t, "latest", version)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryAfter("5", 0))
+	assert.Equal(t, 4*initialBackoff, retryAfter("", 2))
+	assert.Equal(t, maxRetryAfter, retryAfter("3600", 0))
+	assert.Equal(t, time.Duration(0), retryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0))
+}
+
+func TestSelectLatest(t *testing.T) {
+	tags := []tag{
+		{Name: "latest"},
+		{Name: "2024-9-git-aaaaaa"},
+		{Name: "2025-2-git-bbbbbb"},
+		{Name: "2024-12-git-cccccc"},
+		{Name: "1.10.0"},
+		{Name: "v1.9.3"},
+		{Name: "2.0.0-rc1"},
+	}
+
+	latest, ok := selectLatest(tags, TagStrategyDate)
+	require.True(t, ok)
+	assert.Equal(t, "2025-2-git-bbbbbb", latest.Name)
+
+	latest, ok = selectLatest(tags, TagStrategySemver)
+	require.True(t, ok)
+	assert.Equal(t, "1.10.0", latest.Name)
+
+	_, ok = selectLatest([]tag{{Name: "latest"}}, TagStrategyDate)
+	assert.False(t, ok)
+}
+
+func TestGetLatestBitswanGitopsImageOutOfOrder(t *testing.T) {
+	fakeDockerHub(t, respond(http.StatusOK, `{"results": [
+		{"name": "2024-3-git-aaaaaa"},
+		{"name": "2024-12-git-bbbbbb"},
+		{"name": "2024-11-git-cccccc"}
+	]}`))
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-bbbbbb", version)
+}
+
+func TestParseTagStrategy(t *testing.T) {
+	strategy, err := ParseTagStrategy("semver")
+	require.NoError(t, err)
+	assert.Equal(t, TagStrategySemver, strategy)
+
+	_, err = ParseTagStrategy("newest")
+	require.Error(t, err)
+}
+
+func TestGetLatestBitswanGitopsImagePaginated(t *testing.T) {
+	var serverUrl string
+	nextPage := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"next": "` + serverUrl + `/tags/?page=2", "results": [{"name": "latest"}]}`))
+	}
+	requests := fakeDockerHub(t, nextPage, respond(http.StatusOK, tagsPage))
+	serverUrl = strings.TrimSuffix(bitswanGitopsTagsUrl, "/tags/")
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageNewerOnLaterPage(t *testing.T) {
+	var serverUrl string
+	firstPage := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"next": "` + serverUrl + `/tags/?page=2", "results": [{"name": "2024-3-git-aaaaaa"}]}`))
+	}
+	requests := fakeDockerHub(t, firstPage, respond(http.StatusOK, tagsPage))
+	serverUrl = strings.TrimSuffix(bitswanGitopsTagsUrl, "/tags/")
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestGetLatestBitswanGitopsImagePageLimit(t *testing.T) {
+	var serverUrl string
+	handlers := make([]http.HandlerFunc, maxTagPages)
+	for i := range handlers {
+		handlers[i] = func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"next": "` + serverUrl + `/tags/?page=n", "results": [{"name": "latest"}]}`))
+		}
+	}
+	requests := fakeDockerHub(t, handlers...)
+	serverUrl = strings.TrimSuffix(bitswanGitopsTagsUrl, "/tags/")
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.Error(t, err)
+	assert.Equal(t, maxTagPages, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageServerErrors(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusBadGateway, ""), respond(http.StatusServiceUnavailable, ""), respond(http.StatusOK, tagsPage))
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-12-git-abcdef", version)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageRetriesExhausted(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusBadGateway, ""), respond(http.StatusBadGateway, ""))
+	originalRetries := Retries
+	Retries = 1
+	t.Cleanup(func() { Retries = originalRetries })
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.ErrorContains(t, err, "502 Bad Gateway")
+	assert.Equal(t, 2, *requests)
+}
+
+func TestGetLatestBitswanGitopsImageNotRetried(t *testing.T) {
+	requests := fakeDockerHub(t, respond(http.StatusNotFound, ""))
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.ErrorContains(t, err, "404 Not Found")
+	assert.Equal(t, 1, *requests)
+}
@@ -0,0 +1,253 @@
+package dockerhub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// manifestMediaTypes are the manifest formats accepted when asking a registry for an image digest.
+const manifestMediaTypes = "application/vnd.oci.image.index.v1+json, " +
+	"application/vnd.docker.distribution.manifest.list.v2+json, " +
+	"application/vnd.oci.image.manifest.v1+json, " +
+	"application/vnd.docker.distribution.manifest.v2+json"
+
+var (
+	nextLinkPattern       = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+	challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+type registryTagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+type registryTokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// registryClient sends requests to a registry, answering its authentication challenges.
+type registryClient struct {
+	// registry is the registry API URL, credentials are only sent to it
+	registry *url.URL
+	username string
+	password string
+	// authorization is the Authorization header sent with every request, empty until the registry asks for one
+	authorization string
+}
+
+// newRegistryClient logs in with $BITSWAN_REGISTRY_USERNAME and $BITSWAN_REGISTRY_PASSWORD, such as a Harbor robot account,
+// when the registry asks for it. $BITSWAN_REGISTRY_TOKEN is sent as a bearer token up front.
+func newRegistryClient(registry *url.URL) *registryClient {
+	c := &registryClient{
+		registry: registry,
+		username: os.Getenv("BITSWAN_REGISTRY_USERNAME"),
+		password: os.Getenv("BITSWAN_REGISTRY_PASSWORD"),
+	}
+	if token := os.Getenv("BITSWAN_REGISTRY_TOKEN"); token != "" {
+		c.authorization = "Bearer " + token
+	}
+	return c
+}
+
+// get sends a request. When it is rejected with an authentication challenge, the challenge is answered and the request sent once more.
+func (c *registryClient) get(method, target string) ([]byte, http.Header, error) {
+	body, header, err := get(method, target, c.authorization)
+	var unauthorized *unauthorizedError
+	if !errors.As(err, &unauthorized) || unauthorized.challenge == "" {
+		return body, header, err
+	}
+	authorization, authErr := c.authorize(unauthorized.challenge)
+	if authErr != nil {
+		return nil, nil, fmt.Errorf("%w: %v", err, authErr)
+	}
+	c.authorization = authorization
+	return get(method, target, c.authorization)
+}
+
+// authorize answers a WWW-Authenticate challenge with the Authorization header to send.
+// Bearer challenges are answered with a token from the realm, requested with the basic credentials if there are any
+// and the realm is on the registry's own host.
+func (c *registryClient) authorize(challenge string) (string, error) {
+	scheme, _, _ := strings.Cut(challenge, " ")
+	params := map[string]string{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return "", errors.New("the registry requires a login, set $BITSWAN_REGISTRY_USERNAME and $BITSWAN_REGISTRY_PASSWORD")
+		}
+		return c.basic(), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || realm.Host == "" {
+			return "", fmt.Errorf("invalid token realm %q in registry challenge", params["realm"])
+		}
+		query := realm.Query()
+		for _, key := range []string{"service", "scope"} {
+			if params[key] != "" {
+				query.Set(key, params[key])
+			}
+		}
+		realm.RawQuery = query.Encode()
+		authorization := ""
+		trusted := sameHost(c.registry, realm)
+		if c.username != "" && trusted {
+			authorization = c.basic()
+		}
+		body, _, err := get(http.MethodGet, realm.String(), authorization)
+		if err != nil {
+			if c.username != "" && !trusted {
+				return "", fmt.Errorf("error getting a registry token: %w (credentials are only sent to %s, not to the token realm %s)",
+					err, c.registry.Host, realm.Host)
+			}
+			return "", fmt.Errorf("error getting a registry token: %w", err)
+		}
+		var data registryTokenResponse
+		if err := json.Unmarshal(body, &data); err != nil {
+			return "", fmt.Errorf("error reading the registry token: %w", err)
+		}
+		token := data.Token
+		if token == "" {
+			token = data.AccessToken
+		}
+		if token == "" {
+			return "", errors.New("the registry issued no token")
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported registry authentication scheme %q", scheme)
+}
+
+// sameHost reports whether target is on the registry's host and port, over https unless the registry itself is plain http.
+func sameHost(registry, target *url.URL) bool {
+	if target.Scheme != "https" && !(target.Scheme == "http" && registry.Scheme == "http") {
+		return false
+	}
+	return strings.EqualFold(registry.Hostname(), target.Hostname()) && port(registry) == port(target)
+}
+
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if u.Scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+func (c *registryClient) basic() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+}
+
+// RegistryAPI returns the registry to look images up in: registry if set, otherwise $BITSWAN_REGISTRY_API.
+// An empty result means DockerHub.
+func RegistryAPI(registry string) string {
+	if registry == "" {
+		registry = os.Getenv("BITSWAN_REGISTRY_API")
+	}
+	return strings.TrimSuffix(registry, "/")
+}
+
+// ImageRepository returns the bitswan-gitops image repository to pull from the given registry.
+func ImageRepository(registry string) (string, error) {
+	registry = RegistryAPI(registry)
+	if registry == "" {
+		return bitswanGitopsRepository, nil
+	}
+	api, repository, err := registryRepository(registry)
+	if err != nil {
+		return "", err
+	}
+	return api.Host + "/" + repository, nil
+}
+
+// registryRepository splits a registry API URL into the registry itself and the repository to take the image from.
+// A path names the repository, for example https://harbor.example.com/myproject/pipeline-runtime-environment for a
+// Harbor project, without one the bitswan-gitops repository is used.
+func registryRepository(registry string) (*url.URL, string, error) {
+	u, err := url.Parse(registry)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid registry API URL %q, expected something like https://registry.example.com", registry)
+	}
+	repository := strings.Trim(u.Path, "/")
+	if repository == "" {
+		repository = bitswanGitopsRepository
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, repository, nil
+}
+
+func registryTagsUrl(registry, repository string) string {
+	return registry + "/v2/" + repository + "/tags/list"
+}
+
+// getLatestRegistryTag looks up the latest tag through the Docker Registry HTTP API V2, see newRegistryClient for authentication.
+// The digest is optional unless requireDigest is set.
+func getLatestRegistryTag(registry, repository string, strategy TagStrategy, requireDigest bool) (tag, error) {
+	registryUrl, err := url.Parse(registry)
+	if err != nil {
+		return tag{}, err
+	}
+	client := newRegistryClient(registryUrl)
+	pageUrl := registryTagsUrl(registry, repository)
+	var tags []tag
+	for page := 0; page < maxTagPages && pageUrl != ""; page++ {
+		body, header, err := client.get(http.MethodGet, pageUrl)
+		if err != nil {
+			return tag{}, err
+		}
+		var data registryTagsResponse
+		if err := json.Unmarshal(body, &data); err != nil {
+			return tag{}, err
+		}
+		for _, name := range data.Tags {
+			tags = append(tags, tag{Name: name})
+		}
+		pageUrl, err = nextPage(pageUrl, header.Get("Link"))
+		if err != nil {
+			return tag{}, err
+		}
+	}
+
+	latest, ok := selectLatest(tags, strategy)
+	if !ok {
+		return tag{}, errors.New("No valid version found")
+	}
+	// The tag list carries no digests, they have to be read from the manifest
+	_, header, err := client.get(http.MethodHead, registry+"/v2/"+repository+"/manifests/"+latest.Name)
+	if err != nil {
+		if requireDigest {
+			return tag{}, fmt.Errorf("error getting the digest of %s: %w", latest.Name, err)
+		}
+		return latest, nil
+	}
+	latest.Digest = header.Get("Docker-Content-Digest")
+	return latest, nil
+}
+
+// nextPage resolves the rel="next" target of a Link header against the current page, "" if there is none.
+func nextPage(current, link string) (string, error) {
+	match := nextLinkPattern.FindStringSubmatch(link)
+	if match == nil {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(match[1])
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
@@ -0,0 +1,256 @@
+package dockerhub
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	robotUsername = "robot$ci"
+	robotPassword = "robot-secret"
+	issuedToken   = "issued-token"
+)
+
+// fakeRegistry serves a V2 tags/list split over two pages and the manifest digest of one tag.
+// Unless authorization is empty, requests without that Authorization header get a 401 challenging for scheme,
+// for a Bearer challenge /token issues issuedToken to the robot account.
+func fakeRegistry(t *testing.T, authorization, scheme string) *httptest.Server {
+	t.Helper()
+	t.Setenv("BITSWAN_CONFIG_DIR", t.TempDir())
+	t.Setenv("BITSWAN_REGISTRY_TOKEN", "")
+	t.Setenv("BITSWAN_REGISTRY_USERNAME", "")
+	t.Setenv("BITSWAN_REGISTRY_PASSWORD", "")
+	originalBackoff := initialBackoff
+	initialBackoff = time.Millisecond
+	t.Cleanup(func() { initialBackoff = originalBackoff })
+
+	var server *httptest.Server
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if authorization == "" || r.Header.Get("Authorization") == authorization {
+			return true
+		}
+		switch scheme {
+		case "Basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+		case "Bearer":
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+server.URL+`/token",service="fake-registry",scope="repository:`+bitswanGitopsRepository+`:pull"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != robotUsername || password != robotPassword || r.URL.Query().Get("service") != "fake-registry" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token": "` + issuedToken + `"}`))
+	})
+	mux.HandleFunc("/v2/"+bitswanGitopsRepository+"/tags/list", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/`+bitswanGitopsRepository+`/tags/list?last=2024-3-git-aaaaaa&n=2>; rel="next"`)
+			w.Write([]byte(`{"tags": ["latest", "2024-3-git-aaaaaa"]}`))
+			return
+		}
+		w.Write([]byte(`{"tags": ["2024-11-git-bbbbbb"]}`))
+	})
+	mux.HandleFunc("/v2/"+bitswanGitopsRepository+"/manifests/2024-11-git-bbbbbb", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.Header().Set("Docker-Content-Digest", "sha256:ccc")
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistry(t *testing.T) {
+	server := fakeRegistry(t, "Bearer secret-token", "")
+	t.Setenv("BITSWAN_REGISTRY_TOKEN", "secret-token")
+
+	version, digest, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL + "/"})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-11-git-bbbbbb", version)
+	assert.Equal(t, "sha256:ccc", digest)
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryEnv(t *testing.T) {
+	server := fakeRegistry(t, "", "")
+	t.Setenv("BITSWAN_REGISTRY_API", server.URL)
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-11-git-bbbbbb", version)
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryUnauthorized(t *testing.T) {
+	server := fakeRegistry(t, "Bearer secret-token", "")
+	t.Setenv("BITSWAN_REGISTRY_TOKEN", "wrong-token")
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+	require.ErrorContains(t, err, "401 Unauthorized")
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryTokenChallenge(t *testing.T) {
+	server := fakeRegistry(t, "Bearer "+issuedToken, "Bearer")
+	t.Setenv("BITSWAN_REGISTRY_USERNAME", robotUsername)
+	t.Setenv("BITSWAN_REGISTRY_PASSWORD", robotPassword)
+
+	version, digest, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-11-git-bbbbbb", version)
+	assert.Equal(t, "sha256:ccc", digest)
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryTokenChallengeWrongPassword(t *testing.T) {
+	server := fakeRegistry(t, "Bearer "+issuedToken, "Bearer")
+	t.Setenv("BITSWAN_REGISTRY_USERNAME", robotUsername)
+	t.Setenv("BITSWAN_REGISTRY_PASSWORD", "wrong-secret")
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+	require.ErrorContains(t, err, "error getting a registry token")
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryForeignRealm(t *testing.T) {
+	fakeRegistry(t, "", "")
+	t.Setenv("BITSWAN_REGISTRY_USERNAME", robotUsername)
+	t.Setenv("BITSWAN_REGISTRY_PASSWORD", robotPassword)
+
+	// The token realm is on another host, it must never see the robot account
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(tokenServer.Close)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`/token",service="fake-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(registry.Close)
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: registry.URL})
+	require.ErrorContains(t, err, "credentials are only sent to")
+}
+
+func TestSameHost(t *testing.T) {
+	testCases := []struct {
+		registry string
+		target   string
+		expected bool
+	}{
+		{"https://harbor.example.com", "https://harbor.example.com/service/token", true},
+		{"https://harbor.example.com", "https://HARBOR.example.com:443/service/token", true},
+		{"https://harbor.example.com:8443", "https://harbor.example.com/service/token", false},
+		{"https://harbor.example.com", "https://attacker.example.com/token", false},
+		{"https://harbor.example.com", "http://harbor.example.com/service/token", false},
+		{"http://localhost:5000", "http://localhost:5000/token", true},
+	}
+
+	for _, tc := range testCases {
+		registry, err := url.Parse(tc.registry)
+		require.NoError(t, err)
+		target, err := url.Parse(tc.target)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, sameHost(registry, target), tc.target)
+	}
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryBasicChallenge(t *testing.T) {
+	server := fakeRegistry(t, "Basic "+base64.StdEncoding.EncodeToString([]byte(robotUsername+":"+robotPassword)), "Basic")
+	t.Setenv("BITSWAN_REGISTRY_USERNAME", robotUsername)
+	t.Setenv("BITSWAN_REGISTRY_PASSWORD", robotPassword)
+
+	version, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "2024-11-git-bbbbbb", version)
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryBasicChallengeNoCredentials(t *testing.T) {
+	server := fakeRegistry(t, "Basic "+base64.StdEncoding.EncodeToString([]byte(robotUsername+":"+robotPassword)), "Basic")
+
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+	require.ErrorContains(t, err, "BITSWAN_REGISTRY_USERNAME")
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryNoDigest(t *testing.T) {
+	fakeRegistry(t, "", "")
+	requests := 0
+	// No manifests route, so the digest lookup fails
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		w.Write([]byte(`{"tags": ["2024-11-git-bbbbbb"]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	for i := 0; i < 2; i++ {
+		version, digest, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL})
+		require.NoError(t, err)
+		assert.Equal(t, "2024-11-git-bbbbbb", version)
+		assert.Empty(t, digest)
+	}
+	// The tag is cached even without a digest
+	assert.Equal(t, 1, requests)
+
+	// but a lookup that needs the digest asks again, and reports why there is none
+	_, _, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL, RequireDigest: true})
+	require.ErrorContains(t, err, "error getting the digest of 2024-11-git-bbbbbb")
+	require.ErrorContains(t, err, "404 Not Found")
+	assert.Equal(t, 2, requests)
+}
+
+func TestGetLatestBitswanGitopsImageFromRegistryRepositoryPath(t *testing.T) {
+	fakeRegistry(t, "", "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			assert.Equal(t, "/v2/myproject/gitops/manifests/2025-1-git-dddddd", r.URL.Path)
+			w.Header().Set("Docker-Content-Digest", "sha256:ddd")
+			return
+		}
+		assert.Equal(t, "/v2/myproject/gitops/tags/list", r.URL.Path)
+		w.Write([]byte(`{"tags": ["2025-1-git-dddddd"]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	version, digest, err := GetLatestBitswanGitopsImage(LookupOptions{Registry: server.URL + "/myproject/gitops"})
+	require.NoError(t, err)
+	assert.Equal(t, "2025-1-git-dddddd", version)
+	assert.Equal(t, "sha256:ddd", digest)
+}
+
+func TestImageRepository(t *testing.T) {
+	t.Setenv("BITSWAN_REGISTRY_API", "")
+
+	image, err := ImageRepository("")
+	require.NoError(t, err)
+	assert.Equal(t, "bitswan/pipeline-runtime-environment", image)
+
+	image, err = ImageRepository("https://harbor.example.com:8443/")
+	require.NoError(t, err)
+	assert.Equal(t, "harbor.example.com:8443/bitswan/pipeline-runtime-environment", image)
+
+	image, err = ImageRepository("https://harbor.example.com/myproject/gitops/")
+	require.NoError(t, err)
+	assert.Equal(t, "harbor.example.com/myproject/gitops", image)
+
+	_, err = ImageRepository("harbor.example.com")
+	require.Error(t, err)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/bitswan-space/bitswan-gitops/cmd"
@@ -10,8 +9,5 @@ import (
 var version = ""
 
 func main() {
-	if err := cmd.Execute(version); err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
-	}
+	os.Exit(cmd.Execute(version))
 }
@@ -0,0 +1,152 @@
+// Package compose generates the docker-compose setup of a bitswan-gitops deployment.
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options describes the deployment a docker-compose file is generated for.
+type Options struct {
+	// Dest is the deployment directory the files are written to.
+	Dest string
+	// Image is the gitops image repository, "bitswan/pipeline-runtime-environment" if empty.
+	Image string
+	// Version is the tag of Image to run.
+	Version string
+	// CreDir is the directory in the repository holding this CRE's pipelines, "cre-01" if empty.
+	CreDir string
+	// NoCloud adds a local mosquitto broker for standalone deployments.
+	NoCloud bool
+	// Labels are set on every generated service.
+	Labels map[string]string
+	// ProjectName is written as the top-level compose project name, nothing is written if empty.
+	// docker-compose 1.x rejects the name key, so only set it for compose v2.
+	ProjectName string
+	// BindAddress is the host address published ports listen on, all interfaces if empty.
+	BindAddress string
+}
+
+var invalidProjectNameChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// ProjectName derives the compose project name of the deployment in dest the same way docker compose does from a directory name.
+func ProjectName(dest string) string {
+	name := invalidProjectNameChars.ReplaceAllString(strings.ToLower(filepath.Base(filepath.Clean(dest))), "")
+	return strings.TrimLeft(name, "_-")
+}
+
+// CreateDockerComposeFile writes docker-compose.yml, and mosquitto.conf in no-cloud mode, to opts.Dest.
+func CreateDockerComposeFile(opts Options) error {
+	destFullPath, err := filepath.Abs(opts.Dest)
+	if err != nil {
+		return err
+	}
+	sshDir := os.Getenv("HOME") + "/.ssh"
+	image := opts.Image
+	if image == "" {
+		image = "bitswan/pipeline-runtime-environment"
+	}
+	creDir := opts.CreDir
+	if creDir == "" {
+		creDir = "cre-01"
+	}
+
+	// Construct the docker-compose data structure
+	dockerCompose := map[string]interface{}{
+		"version": "3.8",
+		"services": map[string]interface{}{
+			"bitswan_gitops": map[string]interface{}{
+				"image": image + ":" + opts.Version,
+				"volumes": []string{
+					"/etc/bitswan-secrets/:/etc/bitswan-secrets/",
+					destFullPath + "/prod:/repo/",
+					sshDir + ":/root/.ssh",
+					"/var/run/docker.sock:/var/run/docker.sock",
+				},
+				"environment": map[string]string{
+					"BS_WEBHOOK_PORT": "8000",
+					"BS_CRE_DIR":      "/repo/" + creDir,
+					"BS_BITSWAN_DIR":  "/repo/" + creDir,
+				},
+				"env_file": []string{destFullPath + "/.env"},
+			},
+		},
+	}
+
+	if opts.ProjectName != "" {
+		dockerCompose["name"] = opts.ProjectName
+	}
+
+	if opts.NoCloud {
+		if err := addMosquitoToDockercompose(dockerCompose, destFullPath, opts.BindAddress); err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Labels) > 0 {
+		for _, service := range dockerCompose["services"].(map[string]interface{}) {
+			service.(map[string]interface{})["labels"] = opts.Labels
+		}
+	}
+
+	// Open the docker-compose.yml file for writing
+	dcf, err := os.Create(opts.Dest + "/docker-compose.yml")
+	if err != nil {
+		return err
+	}
+	defer dcf.Close()
+
+	// Serialize the docker-compose data structure to YAML and write it to the file
+	encoder := yaml.NewEncoder(dcf)
+	encoder.SetIndent(2) // Optional: Set indentation
+	err = encoder.Encode(dockerCompose)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// publishedPort formats a port mapping that only listens on bindAddress.
+func publishedPort(bindAddress, port string) string {
+	if bindAddress == "" {
+		return port + ":" + port
+	}
+	if strings.Contains(bindAddress, ":") {
+		bindAddress = "[" + bindAddress + "]"
+	}
+	return bindAddress + ":" + port + ":" + port
+}
+
+func addMosquitoToDockercompose(composeMap map[string]interface{}, dest, bindAddress string) error {
+	composeMap["services"].(map[string]interface{})["mosquitto"] = map[string]interface{}{
+		"image":   "eclipse-mosquitto",
+		"ports":   []string{publishedPort(bindAddress, "1883")},
+		"restart": "always",
+		"volumes": []string{"mosquitto:/mosquitto", dest + "/mosquitto.conf:/mosquitto/config/mosquitto.conf"},
+	}
+	if _, ok := composeMap["volumes"]; !ok {
+		composeMap["volumes"] = map[string]interface{}{}
+	}
+	composeMap["volumes"].(map[string]interface{})["mosquitto"] = map[string]interface{}{}
+	mosquitoConf := `persistence true
+persistence_location /mosquitto/data/
+log_dest file /mosquitto/log/mosquitto.log
+allow_anonymous true
+
+# MQTT listener
+listener 1883
+protocol mqtt
+`
+	mosquittoConfFile, err := os.Create(dest + "/mosquitto.conf")
+	if err != nil {
+		return err
+	}
+	defer mosquittoConfFile.Close()
+	_, err = mosquittoConfFile.WriteString(mosquitoConf)
+	return err
+}
@@ -0,0 +1,106 @@
+package compose
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func readCompose(t *testing.T, dest string) map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dest, "docker-compose.yml"))
+	require.NoError(t, err)
+	var dockerCompose map[string]interface{}
+	require.NoError(t, yaml.Unmarshal(data, &dockerCompose))
+	return dockerCompose
+}
+
+func TestCreateDockerComposeFile(t *testing.T) {
+	dest := t.TempDir()
+
+	err := CreateDockerComposeFile(Options{
+		Dest:    dest,
+		Version: "2024-1-git-abcdef",
+		Labels:  map[string]string{"team": "data"},
+	})
+	require.NoError(t, err)
+
+	dockerCompose := readCompose(t, dest)
+	assert.NotContains(t, dockerCompose, "name")
+	services := dockerCompose["services"].(map[string]interface{})
+	require.Len(t, services, 1)
+	gitops := services["bitswan_gitops"].(map[string]interface{})
+	assert.Equal(t, "bitswan/pipeline-runtime-environment:2024-1-git-abcdef", gitops["image"])
+	assert.Contains(t, gitops["volumes"], dest+"/prod:/repo/")
+	assert.Equal(t, "/repo/cre-01", gitops["environment"].(map[string]interface{})["BS_CRE_DIR"])
+	assert.Equal(t, map[string]interface{}{"team": "data"}, gitops["labels"])
+	assert.NoFileExists(t, filepath.Join(dest, "mosquitto.conf"))
+}
+
+func TestCreateDockerComposeFileNoCloud(t *testing.T) {
+	dest := t.TempDir()
+
+	err := CreateDockerComposeFile(Options{
+		Dest:        dest,
+		Image:       "registry.example.com/bitswan/pipeline-runtime-environment",
+		Version:     "latest",
+		CreDir:      "cre-02",
+		NoCloud:     true,
+		ProjectName: "my-gitops",
+		BindAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	dockerCompose := readCompose(t, dest)
+	assert.Equal(t, "my-gitops", dockerCompose["name"])
+	services := dockerCompose["services"].(map[string]interface{})
+	require.Contains(t, services, "mosquitto")
+	assert.Equal(t, []interface{}{"127.0.0.1:1883:1883"}, services["mosquitto"].(map[string]interface{})["ports"])
+	assert.Equal(t, "registry.example.com/bitswan/pipeline-runtime-environment:latest", services["bitswan_gitops"].(map[string]interface{})["image"])
+	assert.Equal(t, "/repo/cre-02", services["bitswan_gitops"].(map[string]interface{})["environment"].(map[string]interface{})["BS_CRE_DIR"])
+	assert.Contains(t, dockerCompose["volumes"], "mosquitto")
+	assert.FileExists(t, filepath.Join(dest, "mosquitto.conf"))
+}
+
+func TestProjectName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		dest     string
+		expected string
+	}{
+		{
+			name:     "plain directory",
+			dest:     "bitswan-gitops",
+			expected: "bitswan-gitops",
+		},
+		{
+			name:     "nested path with trailing slash",
+			dest:     "/srv/deployments/prod_01/",
+			expected: "prod_01",
+		},
+		{
+			name:     "uppercase and invalid characters",
+			dest:     "./My.GitOps",
+			expected: "mygitops",
+		},
+		{
+			name:     "leading separators",
+			dest:     "_-gitops",
+			expected: "gitops",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, ProjectName(tc.dest), tc.name)
+	}
+}
+
+func TestPublishedPort(t *testing.T) {
+	assert.Equal(t, "1883:1883", publishedPort("", "1883"))
+	assert.Equal(t, "127.0.0.1:1883:1883", publishedPort("127.0.0.1", "1883"))
+	assert.Equal(t, "[::1]:1883:1883", publishedPort("::1", "1883"))
+}